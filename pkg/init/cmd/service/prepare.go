@@ -5,12 +5,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	goruntime "runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/syndtr/gocapability/capability"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 )
 
@@ -19,14 +27,74 @@ const (
 	nsenterPath = "/usr/bin/nsenter-net"
 )
 
+// idmapHelperEnv, when set in the environment, tells this binary to do
+// nothing but block forever. It is used to re-exec this same binary as the
+// idmap helper process in buildIDMapUserns, since the minimal rootfs this
+// binary normally runs in cannot be relied on to have any other userland
+// binary (e.g. /bin/sleep) available to anchor the namespace with.
+const idmapHelperEnv = "LINUXKIT_IDMAP_HELPER"
+
+func init() {
+	if os.Getenv(idmapHelperEnv) != "" {
+		// a bare select {} would be reported by the runtime as a deadlock,
+		// as no other goroutine exists yet; a pending timer avoids that
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+}
+
 // Note these definitions are from moby/tool/src/moby/config.go and should be kept in sync
 
 // Runtime is the type of config processed at runtime, not used to build the OCI spec
 type Runtime struct {
-	Mounts     []specs.Mount `yaml:"mounts" json:"mounts,omitempty"`
-	Mkdir      []string      `yaml:"mkdir" json:"mkdir,omitempty"`
-	Interfaces []Interface   `yaml:"interfaces" json:"interfaces,omitempty"`
-	BindNS     Namespaces    `yaml:"bindNS" json:"bindNS,omitempty"`
+	Mounts       []RuntimeMount `yaml:"mounts" json:"mounts,omitempty"`
+	Mkdir        []string       `yaml:"mkdir" json:"mkdir,omitempty"`
+	Interfaces   []Interface    `yaml:"interfaces" json:"interfaces,omitempty"`
+	BindNS       Namespaces     `yaml:"bindNS" json:"bindNS,omitempty"`
+	Rlimits      []Rlimit       `yaml:"rlimits" json:"rlimits,omitempty"`
+	Capabilities *Capabilities  `yaml:"capabilities" json:"capabilities,omitempty"`
+}
+
+// RuntimeMount extends an OCI specs.Mount with LinuxKit-specific extras that
+// are not part of the runtime spec
+type RuntimeMount struct {
+	specs.Mount `yaml:",inline"`
+	IDMap       *IDMap `yaml:"idmap" json:"idmap,omitempty"`
+}
+
+// IDMap describes a uid/gid mapping to apply to a bind mount via
+// mount_setattr(MOUNT_ATTR_IDMAP), for rootless-style id-mapped mounts that
+// expose a host path under a shifted uid range
+type IDMap struct {
+	UIDMap []IDMapEntry `yaml:"uidMap" json:"uidMap,omitempty"`
+	GIDMap []IDMapEntry `yaml:"gidMap" json:"gidMap,omitempty"`
+}
+
+// IDMapEntry is a single line of a uid_map/gid_map, see user_namespaces(7)
+type IDMapEntry struct {
+	ContainerID int `yaml:"containerID" json:"containerID,omitempty"`
+	HostID      int `yaml:"hostID" json:"hostID,omitempty"`
+	Size        int `yaml:"size" json:"size,omitempty"`
+}
+
+// Rlimit is the runtime config for a single POSIX resource limit, modelled on
+// the rlimitsMap buildah uses to configure its chroot subprocess
+type Rlimit struct {
+	Type string `yaml:"type" json:"type,omitempty"`
+	Hard uint64 `yaml:"hard" json:"hard,omitempty"`
+	Soft uint64 `yaml:"soft" json:"soft,omitempty"`
+}
+
+// Capabilities is the runtime config for the Linux capability sets to apply
+// to the process before it execs into the container, letting init/onboot
+// containers declaratively drop privileges
+type Capabilities struct {
+	Bounding    []string `yaml:"bounding" json:"bounding,omitempty"`
+	Effective   []string `yaml:"effective" json:"effective,omitempty"`
+	Inheritable []string `yaml:"inheritable" json:"inheritable,omitempty"`
+	Permitted   []string `yaml:"permitted" json:"permitted,omitempty"`
+	Ambient     []string `yaml:"ambient" json:"ambient,omitempty"`
 }
 
 // Namespaces is the type for configuring paths to bind namespaces
@@ -42,10 +110,60 @@ type Namespaces struct {
 
 // Interface is the runtime config for network interfaces
 type Interface struct {
-	Name         string `yaml:"name" json:"name,omitempty"`
-	Add          string `yaml:"add" json:"add,omitempty"`
-	Peer         string `yaml:"peer" json:"peer,omitempty"`
-	CreateInRoot bool   `yaml:"createInRoot" json:"createInRoot"`
+	Name          string          `yaml:"name" json:"name,omitempty"`
+	Add           string          `yaml:"add" json:"add,omitempty"`
+	Peer          string          `yaml:"peer" json:"peer,omitempty"`
+	CreateInRoot  bool            `yaml:"createInRoot" json:"createInRoot"`
+	PrivateKey    string          `yaml:"privateKey" json:"privateKey,omitempty"`
+	ListenPort    int             `yaml:"listenPort" json:"listenPort,omitempty"`
+	FwMark        int             `yaml:"fwMark" json:"fwMark,omitempty"`
+	Peers         []WireguardPeer `yaml:"peers" json:"peers,omitempty"`
+	Addresses     []string        `yaml:"addresses" json:"addresses,omitempty"`
+	Routes        []Route         `yaml:"routes" json:"routes,omitempty"`
+	MTU           int             `yaml:"mtu" json:"mtu,omitempty"`
+	MacAddress    string          `yaml:"macAddress" json:"macAddress,omitempty"`
+	Up            *bool           `yaml:"up" json:"up,omitempty"`
+	PeerAddresses []string        `yaml:"peerAddresses" json:"peerAddresses,omitempty"`
+	PeerRoutes    []Route         `yaml:"peerRoutes" json:"peerRoutes,omitempty"`
+	Parent        string          `yaml:"parent" json:"parent,omitempty"`
+	// Mode is interpreted according to Add: macvlan mode (bridge/vepa/private/passthru),
+	// ipvlan mode (l2/l3/l3s) or bond mode (e.g. active-backup, 802.3ad)
+	Mode          string `yaml:"mode" json:"mode,omitempty"`
+	Flag          string `yaml:"flag" json:"flag,omitempty"`
+	VlanID        int    `yaml:"vlanId" json:"vlanId,omitempty"`
+	VlanProtocol  string `yaml:"vlanProtocol" json:"vlanProtocol,omitempty"`
+	VlanFiltering *bool  `yaml:"vlanFiltering" json:"vlanFiltering,omitempty"`
+	AgeingTime    int    `yaml:"ageingTime" json:"ageingTime,omitempty"`
+	HelloTime     int    `yaml:"helloTime" json:"helloTime,omitempty"`
+	Miimon        int    `yaml:"miimon" json:"miimon,omitempty"`
+	LacpRate      string `yaml:"lacpRate" json:"lacpRate,omitempty"`
+	Master        string `yaml:"master" json:"master,omitempty"`
+}
+
+// Route is the runtime config for a route to add to an interface, applied in
+// the namespace the interface ends up in
+type Route struct {
+	Dst    string `yaml:"dst" json:"dst,omitempty"`
+	Gw     string `yaml:"gw" json:"gw,omitempty"`
+	Metric int    `yaml:"metric" json:"metric,omitempty"`
+	Scope  string `yaml:"scope" json:"scope,omitempty"`
+	Table  int    `yaml:"table" json:"table,omitempty"`
+}
+
+// isUp reports whether an interface should be brought up, defaulting to true
+// when Up is not explicitly set
+func isUp(up *bool) bool {
+	return up == nil || *up
+}
+
+// WireguardPeer is the runtime config for a single WireGuard peer, to be
+// rendered into the `[Peer]` section of a wg-quick style config file
+type WireguardPeer struct {
+	PublicKey           string   `yaml:"publicKey" json:"publicKey,omitempty"`
+	PresharedKey        string   `yaml:"presharedKey" json:"presharedKey,omitempty"`
+	Endpoint            string   `yaml:"endpoint" json:"endpoint,omitempty"`
+	AllowedIPs          []string `yaml:"allowedIPs" json:"allowedIPs,omitempty"`
+	PersistentKeepalive int      `yaml:"persistentKeepalive" json:"persistentKeepalive,omitempty"`
 }
 
 func getRuntimeConfig(path string) Runtime {
@@ -64,13 +182,29 @@ func getRuntimeConfig(path string) Runtime {
 	return runtime
 }
 
+// propagationFlags are mount propagation options. The kernel requires these
+// to be set via a dedicated unix.Mount call with no other flags, source,
+// fstype or data, so they are parsed out of parseMountOptions separately
+// from the regular mount flags.
+var propagationFlags = map[string]int{
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"shared":      unix.MS_SHARED,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
 // parseMountOptions takes fstab style mount options and parses them for
 // use with a standard mount() syscall
 // taken from containerd, where it is not exported
-func parseMountOptions(options []string) (int, string) {
+func parseMountOptions(options []string) (int, int, string) {
 	var (
-		flag int
-		data []string
+		flag        int
+		propagation int
+		data        []string
 	)
 	flags := map[string]struct {
 		clear bool
@@ -84,6 +218,7 @@ func parseMountOptions(options []string) (int, string) {
 		"diratime":      {true, unix.MS_NODIRATIME},
 		"dirsync":       {false, unix.MS_DIRSYNC},
 		"exec":          {true, unix.MS_NOEXEC},
+		"lazytime":      {false, unix.MS_LAZYTIME},
 		"mand":          {false, unix.MS_MANDLOCK},
 		"noatime":       {false, unix.MS_NOATIME},
 		"nodev":         {false, unix.MS_NODEV},
@@ -93,6 +228,7 @@ func parseMountOptions(options []string) (int, string) {
 		"norelatime":    {true, unix.MS_RELATIME},
 		"nostrictatime": {true, unix.MS_STRICTATIME},
 		"nosuid":        {false, unix.MS_NOSUID},
+		"nosymfollow":   {false, unix.MS_NOSYMFOLLOW},
 		"rbind":         {false, unix.MS_BIND | unix.MS_REC},
 		"relatime":      {false, unix.MS_RELATIME},
 		"remount":       {false, unix.MS_REMOUNT},
@@ -103,6 +239,10 @@ func parseMountOptions(options []string) (int, string) {
 		"sync":          {false, unix.MS_SYNCHRONOUS},
 	}
 	for _, o := range options {
+		if p, exists := propagationFlags[o]; exists {
+			propagation |= p
+			continue
+		}
 		// If the option does not exist in the flags table or the flag
 		// is not supported on the platform,
 		// then it is a data value for a specific fs type
@@ -116,30 +256,257 @@ func parseMountOptions(options []string) (int, string) {
 			data = append(data, o)
 		}
 	}
-	return flag, strings.Join(data, ",")
+	return flag, propagation, strings.Join(data, ",")
+}
+
+// rootRelative computes target's path relative to root, refusing a target
+// that escapes root (e.g. via "..") once cleaned
+func rootRelative(root, target string) (string, error) {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return "", fmt.Errorf("Cannot make %s relative to %s: %v", target, root, err)
+	}
+	rel = filepath.Clean(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("Path %s escapes root %s", target, root)
+	}
+	return rel, nil
+}
+
+// secureMkdirAll behaves like os.MkdirAll but resolves target component by
+// component under root using openat(O_NOFOLLOW), refusing to traverse
+// through any symlink. This closes the same class of TOCTOU bug as
+// CVE-2021-30465 in runc, where a symlink planted at the destination path
+// mid-operation could redirect a later operation outside of root.
+func secureMkdirAll(root, target string, mode os.FileMode) error {
+	rel, err := rootRelative(root, target)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	rootFd, err := unix.Open(root, unix.O_DIRECTORY|unix.O_PATH, 0)
+	if err != nil {
+		return fmt.Errorf("Cannot open root %s: %v", root, err)
+	}
+	defer unix.Close(rootFd)
+
+	dirFd := rootFd
+	for _, part := range strings.Split(rel, "/") {
+		if err := unix.Mkdirat(dirFd, part, uint32(mode)); err != nil && err != unix.EEXIST {
+			return fmt.Errorf("Cannot create directory %s under %s: %v", part, root, err)
+		}
+		newFd, err := unix.Openat(dirFd, part, unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_PATH, 0)
+		if err != nil {
+			return fmt.Errorf("Refusing to create %s under %s, possible symlink at %s: %v", target, root, part, err)
+		}
+		if dirFd != rootFd {
+			unix.Close(dirFd)
+		}
+		dirFd = newFd
+	}
+	unix.Close(dirFd)
+	return nil
+}
+
+// secureOpen resolves target component by component under root using
+// openat(O_NOFOLLOW), refusing any component that is a symlink, and returns
+// an open O_PATH descriptor for the final component along with its
+// /proc/self/fd path. Mounting against the returned path instead of target
+// itself guarantees the mount lands on the descriptor that was actually
+// resolved, even if target is swapped for a symlink immediately afterwards.
+// The caller must close the returned descriptor.
+func secureOpen(root, target string) (int, string, error) {
+	rel, err := rootRelative(root, target)
+	if err != nil {
+		return -1, "", err
+	}
+	rootFd, err := unix.Open(root, unix.O_DIRECTORY|unix.O_PATH, 0)
+	if err != nil {
+		return -1, "", fmt.Errorf("Cannot open root %s: %v", root, err)
+	}
+	defer unix.Close(rootFd)
+
+	dirFd := rootFd
+	if rel != "." {
+		for _, part := range strings.Split(rel, "/") {
+			newFd, err := unix.Openat(dirFd, part, unix.O_PATH|unix.O_NOFOLLOW, 0)
+			if err != nil {
+				return -1, "", fmt.Errorf("Refusing to resolve %s under %s, possible symlink at %s: %v", target, root, part, err)
+			}
+			if dirFd != rootFd {
+				unix.Close(dirFd)
+			}
+			dirFd = newFd
+		}
+		// O_PATH|O_NOFOLLOW opens a final symlink component as the link
+		// itself rather than failing, so check for that explicitly
+		var st unix.Stat_t
+		if err := unix.Fstat(dirFd, &st); err != nil {
+			unix.Close(dirFd)
+			return -1, "", fmt.Errorf("Cannot stat %s under %s: %v", target, root, err)
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			unix.Close(dirFd)
+			return -1, "", fmt.Errorf("Refusing to resolve %s under %s, it is a symlink", target, root)
+		}
+	} else {
+		newFd, err := unix.Openat(dirFd, ".", unix.O_PATH, 0)
+		if err != nil {
+			return -1, "", err
+		}
+		dirFd = newFd
+	}
+	return dirFd, fmt.Sprintf("/proc/self/fd/%d", dirFd), nil
+}
+
+// secureMount resolves destination under root without following symlinks and
+// mounts source onto the resolved descriptor. If propagation is non-zero, a
+// second mount call is issued to set the propagation type, as the kernel
+// requires that to be done separately from the initial mount.
+func secureMount(root, destination, source, fstype string, flags uintptr, propagation uintptr, data string) error {
+	const mode os.FileMode = 0755
+	if err := secureMkdirAll(root, destination, mode); err != nil {
+		return err
+	}
+	fd, fdPath, err := secureOpen(root, destination)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Mount(source, fdPath, fstype, flags, data); err != nil {
+		return err
+	}
+	if propagation != 0 {
+		if err := unix.Mount("", fdPath, "", propagation, ""); err != nil {
+			return fmt.Errorf("Cannot set mount propagation on %s: %v", destination, err)
+		}
+	}
+	return nil
+}
+
+// formatIDMap renders uid/gid map entries in the /proc/<pid>/{uid,gid}_map
+// format documented in user_namespaces(7): "<container-id> <host-id> <size>"
+func formatIDMap(entries []IDMapEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%d %d %d\n", e.ContainerID, e.HostID, e.Size)
+	}
+	return b.String()
+}
+
+// buildIDMapUserns creates a short-lived helper process in a new user
+// namespace, applies idmap's mappings to it via /proc/<pid>/{uid,gid}_map,
+// and returns an open file descriptor for that namespace suitable for
+// MOUNT_ATTR_IDMAP. The helper is killed once the descriptor has been
+// obtained.
+func buildIDMapUserns(idmap *IDMap) (int, error) {
+	if len(idmap.UIDMap) == 0 && len(idmap.GIDMap) == 0 {
+		return -1, fmt.Errorf("idmap requires at least one uidMap or gidMap entry")
+	}
+
+	// re-exec ourselves as the helper process so we don't depend on any other
+	// userland binary being present in the rootfs to anchor the namespace
+	self, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return -1, fmt.Errorf("cannot resolve own executable path: %v", err)
+	}
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(), idmapHelperEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWUSER}
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("cannot start idmap helper process: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	if err := ioutil.WriteFile(fmt.Sprintf("/proc/%d/setgroups", pid), []byte("deny"), 0644); err != nil {
+		return -1, fmt.Errorf("cannot disable setgroups for idmap helper: %v", err)
+	}
+	if len(idmap.UIDMap) > 0 {
+		if err := ioutil.WriteFile(fmt.Sprintf("/proc/%d/uid_map", pid), []byte(formatIDMap(idmap.UIDMap)), 0644); err != nil {
+			return -1, fmt.Errorf("cannot write uid_map for idmap helper: %v", err)
+		}
+	}
+	if len(idmap.GIDMap) > 0 {
+		if err := ioutil.WriteFile(fmt.Sprintf("/proc/%d/gid_map", pid), []byte(formatIDMap(idmap.GIDMap)), 0644); err != nil {
+			return -1, fmt.Errorf("cannot write gid_map for idmap helper: %v", err)
+		}
+	}
+
+	fd, err := unix.Open(fmt.Sprintf("/proc/%d/ns/user", pid), unix.O_RDONLY, 0)
+	if err != nil {
+		return -1, fmt.Errorf("cannot open user namespace of idmap helper: %v", err)
+	}
+	return fd, nil
+}
+
+// applyIDMap builds a user namespace with idmap's mappings and applies it to
+// the mount at destination via mount_setattr(MOUNT_ATTR_IDMAP), giving
+// rootless-style id-mapped bind mounts for onboot containers that need to
+// expose a host path under a shifted uid range
+func applyIDMap(root, destination string, idmap *IDMap) error {
+	usernsFd, err := buildIDMapUserns(idmap)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(usernsFd)
+
+	fd, fdPath, err := secureOpen(root, destination)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	treeFd, err := unix.OpenTree(-1, fdPath, unix.OPEN_TREE_CLONE|unix.AT_RECURSIVE)
+	if err != nil {
+		return fmt.Errorf("open_tree failed on %s: %v", destination, err)
+	}
+	defer unix.Close(treeFd)
+
+	attr := unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(usernsFd),
+	}
+	if err := unix.MountSetattr(treeFd, "", unix.AT_EMPTY_PATH|unix.AT_RECURSIVE, &attr); err != nil {
+		return fmt.Errorf("mount_setattr failed on %s: %v", destination, err)
+	}
+	if err := unix.MoveMount(treeFd, "", unix.AT_FDCWD, fdPath, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("move_mount failed on %s: %v", destination, err)
+	}
+	return nil
 }
 
 // prepareFilesystem sets up the mounts, before the container is created
 func prepareFilesystem(path string, runtime Runtime) error {
+	rootfs := filepath.Join(path, "rootfs")
+
 	// execute the runtime config that should be done up front
 	// we execute Mounts before Mkdir so you can make a directory under a mount
 	// but we do mkdir of the destination path in case missing
 	for _, mount := range runtime.Mounts {
-		const mode os.FileMode = 0755
-		err := os.MkdirAll(mount.Destination, mode)
-		if err != nil {
-			return fmt.Errorf("Cannot create directory for mount destination %s: %v", mount.Destination, err)
-		}
-		opts, data := parseMountOptions(mount.Options)
-		if err := unix.Mount(mount.Source, mount.Destination, mount.Type, uintptr(opts), data); err != nil {
+		opts, propagation, data := parseMountOptions(mount.Options)
+		// mount.Destination is a container-rooted path (e.g. "/etc/resolv.conf"),
+		// so it must be joined under rootfs before being walked, not compared
+		// against rootfs as if it were already a host path
+		destination := filepath.Join(rootfs, mount.Destination)
+		if err := secureMount(rootfs, destination, mount.Source, mount.Type, uintptr(opts), uintptr(propagation), data); err != nil {
 			return fmt.Errorf("Failed to mount %s: %v", mount.Source, err)
 		}
+		if mount.IDMap != nil {
+			if err := applyIDMap(rootfs, destination, mount.IDMap); err != nil {
+				return fmt.Errorf("Failed to apply id-mapping to mount %s: %v", mount.Destination, err)
+			}
+		}
 	}
 	for _, dir := range runtime.Mkdir {
 		// in future we may need to change the structure to set mode, ownership
 		const mode os.FileMode = 0755
-		err := os.MkdirAll(dir, mode)
-		if err != nil {
+		if err := secureMkdirAll(rootfs, filepath.Join(rootfs, dir), mode); err != nil {
 			return fmt.Errorf("Cannot create directory %s: %v", dir, err)
 		}
 	}
@@ -176,16 +543,33 @@ func prepareRW(path string) error {
 	}
 	upper := filepath.Join(tmp, "upper")
 	// make the mount points
-	if err := os.Mkdir(upper, 0755); err != nil {
+	if err := secureMkdirAll(path, upper, 0755); err != nil {
 		return err
 	}
 	work := filepath.Join(tmp, "work")
-	if err := os.Mkdir(work, 0755); err != nil {
+	if err := secureMkdirAll(path, work, 0755); err != nil {
 		return err
 	}
 	lower := filepath.Join(path, "lower")
 	rootfs := filepath.Join(path, "rootfs")
-	opt := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+
+	lowerFd, lowerPath, err := secureOpen(path, lower)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(lowerFd)
+	upperFd, upperPath, err := secureOpen(path, upper)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(upperFd)
+	workFd, workPath, err := secureOpen(path, work)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(workFd)
+
+	opt := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerPath, upperPath, workPath)
 	if err := unix.Mount("overlay", rootfs, "overlay", 0, opt); err != nil {
 		return err
 	}
@@ -199,17 +583,21 @@ func bindNS(ns string, path string, pid int) error {
 	}
 	// the path and file need to exist for the bind to succeed, so try to create
 	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := secureMkdirAll("/", dir, 0755); err != nil {
 		return fmt.Errorf("Cannot create leading directories %s for bind mount destination: %v", dir, err)
 	}
-	fi, err := os.Create(path)
+	dirFd, _, err := secureOpen("/", dir)
 	if err != nil {
-		return fmt.Errorf("Cannot create a mount point for namespace bind at %s: %v", path, err)
+		return fmt.Errorf("Cannot resolve leading directories %s for bind mount destination: %v", dir, err)
 	}
-	if err := fi.Close(); err != nil {
-		return err
+	defer unix.Close(dirFd)
+	fileFd, err := unix.Openat(dirFd, filepath.Base(path), unix.O_CREAT|unix.O_NOFOLLOW|unix.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("Cannot create a mount point for namespace bind at %s: %v", path, err)
 	}
-	if err := unix.Mount(fmt.Sprintf("/proc/%d/ns/%s", pid, ns), path, "", unix.MS_BIND, ""); err != nil {
+	defer unix.Close(fileFd)
+	fdPath := fmt.Sprintf("/proc/self/fd/%d", fileFd)
+	if err := unix.Mount(fmt.Sprintf("/proc/%d/ns/%s", pid, ns), fdPath, "", unix.MS_BIND, ""); err != nil {
 		return fmt.Errorf("Failed to bind %s namespace at %s: %v", ns, path, err)
 	}
 	return nil
@@ -234,13 +622,25 @@ func prepareProcess(pid int, runtime Runtime) error {
 		}
 
 		// if create in root is set, create in root namespace first, then move
-		// also do the same for a veth pair
-		if iface.CreateInRoot || iface.Add == "veth" {
+		// also do the same for a veth pair, and for any kind that attaches to a
+		// parent link, since the parent normally lives in the root namespace
+		hasParent := iface.Add == "macvlan" || iface.Add == "ipvlan" || iface.Add == "vlan"
+		if iface.CreateInRoot || iface.Add == "veth" || hasParent {
 			ns = nil
 			move = true
 		}
 
 		if iface.Add != "" {
+			var parent netlink.Link
+			if hasParent {
+				if iface.Parent == "" {
+					return fmt.Errorf("Creating a %s interface %s requires a parent to be set", iface.Add, iface.Name)
+				}
+				parent, err = netlink.LinkByName(iface.Parent)
+				if err != nil {
+					return fmt.Errorf("Cannot find parent interface %s: %v", iface.Parent, err)
+				}
+			}
 			switch iface.Add {
 			case "veth":
 				if iface.Peer == "" {
@@ -248,6 +648,65 @@ func prepareProcess(pid int, runtime Runtime) error {
 				}
 				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns}
 				link = &netlink.Veth{LinkAttrs: la, PeerName: iface.Peer}
+			case "macvlan":
+				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns, ParentIndex: parent.Attrs().Index}
+				mode, err := macvlanModeFromName(iface.Mode)
+				if err != nil {
+					return err
+				}
+				link = &netlink.Macvlan{LinkAttrs: la, Mode: mode}
+			case "ipvlan":
+				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns, ParentIndex: parent.Attrs().Index}
+				mode, err := ipvlanModeFromName(iface.Mode)
+				if err != nil {
+					return err
+				}
+				flag, err := ipvlanFlagFromName(iface.Flag)
+				if err != nil {
+					return err
+				}
+				link = &netlink.IPVlan{LinkAttrs: la, Mode: mode, Flag: flag}
+			case "vlan":
+				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns, ParentIndex: parent.Attrs().Index}
+				protocol, err := vlanProtocolFromName(iface.VlanProtocol)
+				if err != nil {
+					return err
+				}
+				link = &netlink.Vlan{LinkAttrs: la, VlanId: iface.VlanID, VlanProtocol: protocol}
+			case "bridge":
+				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns}
+				br := &netlink.Bridge{LinkAttrs: la}
+				if iface.VlanFiltering != nil {
+					br.VlanFiltering = iface.VlanFiltering
+				}
+				if iface.AgeingTime != 0 {
+					ageingTime := uint32(iface.AgeingTime)
+					br.AgeingTime = &ageingTime
+				}
+				if iface.HelloTime != 0 {
+					helloTime := uint32(iface.HelloTime)
+					br.HelloTime = &helloTime
+				}
+				link = br
+			case "bond":
+				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns}
+				bond := netlink.NewLinkBond(la)
+				mode, err := bondModeFromName(iface.Mode)
+				if err != nil {
+					return err
+				}
+				bond.Mode = mode
+				if iface.Miimon != 0 {
+					bond.Miimon = iface.Miimon
+				}
+				if iface.LacpRate != "" {
+					rate, err := bondLacpRateFromName(iface.LacpRate)
+					if err != nil {
+						return err
+					}
+					bond.LacpRate = rate
+				}
+				link = bond
 			default:
 				// no special creation options needed
 				la := netlink.LinkAttrs{Name: iface.Name, Namespace: ns}
@@ -272,6 +731,22 @@ func prepareProcess(pid int, runtime Runtime) error {
 			}
 			fmt.Fprintf(os.Stderr, "Moved interface %s to pid %d\n", iface.Name, pid)
 		}
+
+		if iface.Add == "wireguard" {
+			if err := configureWireguard(pid, iface); err != nil {
+				return fmt.Errorf("Cannot configure wireguard interface %s: %v", iface.Name, err)
+			}
+		}
+
+		if err := configureInterface(pid, iface); err != nil {
+			return fmt.Errorf("Cannot configure interface %s: %v", iface.Name, err)
+		}
+
+		if iface.Add == "veth" && (len(iface.PeerAddresses) > 0 || len(iface.PeerRoutes) > 0) {
+			if err := configurePeerInterface(iface); err != nil {
+				return fmt.Errorf("Cannot configure peer interface %s: %v", iface.Peer, err)
+			}
+		}
 	}
 
 	binds := []struct {
@@ -296,6 +771,446 @@ func prepareProcess(pid int, runtime Runtime) error {
 	return nil
 }
 
+// wireguardConfig renders a wg-quick style configuration file for the given
+// interface, suitable for `wg setconf`
+func wireguardConfig(iface Interface) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\n")
+	if iface.PrivateKey != "" {
+		fmt.Fprintf(&b, "PrivateKey=%s\n", iface.PrivateKey)
+	}
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort=%d\n", iface.ListenPort)
+	}
+	if iface.FwMark != 0 {
+		fmt.Fprintf(&b, "FwMark=%d\n", iface.FwMark)
+	}
+	for _, peer := range iface.Peers {
+		fmt.Fprintf(&b, "[Peer]\n")
+		if peer.PublicKey != "" {
+			fmt.Fprintf(&b, "PublicKey=%s\n", peer.PublicKey)
+		}
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&b, "PresharedKey=%s\n", peer.PresharedKey)
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint=%s\n", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) != 0 {
+			fmt.Fprintf(&b, "AllowedIPs=%s\n", strings.Join(peer.AllowedIPs, ","))
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive=%d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}
+
+// configureWireguard writes out a wg-quick style config for iface and applies
+// it to the interface inside the target pid's network namespace by running
+// `wg setconf` via nsenter-net, so the container does not need to embed `wg`
+// itself
+func configureWireguard(pid int, iface Interface) error {
+	conf, err := ioutil.TempFile("", "wg-"+iface.Name)
+	if err != nil {
+		return fmt.Errorf("Cannot create wireguard config file: %v", err)
+	}
+	defer os.Remove(conf.Name())
+	if _, err := conf.WriteString(wireguardConfig(iface)); err != nil {
+		conf.Close()
+		return fmt.Errorf("Cannot write wireguard config file: %v", err)
+	}
+	if err := conf.Close(); err != nil {
+		return fmt.Errorf("Cannot write wireguard config file: %v", err)
+	}
+	cmd := exec.Command(nsenterPath, strconv.Itoa(pid), wgPath, "setconf", iface.Name, conf.Name())
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("wg setconf failed: %v", err)
+	}
+	return nil
+}
+
+// macvlanModeFromName maps a macvlan mode name to its netlink constant
+func macvlanModeFromName(mode string) (netlink.MacvlanMode, error) {
+	switch mode {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	default:
+		return 0, fmt.Errorf("unknown macvlan mode %q", mode)
+	}
+}
+
+// ipvlanModeFromName maps an ipvlan mode name to its netlink constant
+func ipvlanModeFromName(mode string) (netlink.IPVlanMode, error) {
+	switch mode {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode %q", mode)
+	}
+}
+
+// ipvlanFlagFromName maps an ipvlan flag name to its netlink constant
+func ipvlanFlagFromName(flag string) (netlink.IPVlanFlag, error) {
+	switch flag {
+	case "", "bridge":
+		return netlink.IPVLAN_FLAG_BRIDGE, nil
+	case "private":
+		return netlink.IPVLAN_FLAG_PRIVATE, nil
+	case "vepa":
+		return netlink.IPVLAN_FLAG_VEPA, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan flag %q", flag)
+	}
+}
+
+// vlanProtocolFromName maps a vlan protocol name to its netlink constant
+func vlanProtocolFromName(protocol string) (netlink.VlanProtocol, error) {
+	switch protocol {
+	case "", "802.1q":
+		return netlink.VLAN_PROTOCOL_8021Q, nil
+	case "802.1ad":
+		return netlink.VLAN_PROTOCOL_8021AD, nil
+	default:
+		return 0, fmt.Errorf("unknown vlan protocol %q", protocol)
+	}
+}
+
+// bondModeFromName maps a bonding mode name to its netlink constant
+func bondModeFromName(mode string) (netlink.BondMode, error) {
+	switch mode {
+	case "", "balance-rr":
+		return netlink.BOND_MODE_BALANCE_RR, nil
+	case "active-backup":
+		return netlink.BOND_MODE_ACTIVE_BACKUP, nil
+	case "balance-xor":
+		return netlink.BOND_MODE_BALANCE_XOR, nil
+	case "broadcast":
+		return netlink.BOND_MODE_BROADCAST, nil
+	case "802.3ad":
+		return netlink.BOND_MODE_802_3AD, nil
+	case "balance-tlb":
+		return netlink.BOND_MODE_BALANCE_TLB, nil
+	case "balance-alb":
+		return netlink.BOND_MODE_BALANCE_ALB, nil
+	default:
+		return 0, fmt.Errorf("unknown bond mode %q", mode)
+	}
+}
+
+// bondLacpRateFromName maps a bonding LACP rate name to its netlink constant
+func bondLacpRateFromName(rate string) (netlink.BondLacpRate, error) {
+	switch rate {
+	case "", "slow":
+		return netlink.BOND_LACP_RATE_SLOW, nil
+	case "fast":
+		return netlink.BOND_LACP_RATE_FAST, nil
+	default:
+		return 0, fmt.Errorf("unknown bond lacp rate %q", rate)
+	}
+}
+
+// parseRouteScope maps an iproute2 style scope name to a netlink route scope
+func parseRouteScope(scope string) (netlink.Scope, error) {
+	switch scope {
+	case "", "universe":
+		return netlink.SCOPE_UNIVERSE, nil
+	case "site":
+		return netlink.SCOPE_SITE, nil
+	case "link":
+		return netlink.SCOPE_LINK, nil
+	case "host":
+		return netlink.SCOPE_HOST, nil
+	case "nowhere":
+		return netlink.SCOPE_NOWHERE, nil
+	default:
+		return 0, fmt.Errorf("unknown route scope %q", scope)
+	}
+}
+
+// buildRoute turns a Route into a netlink.Route bound to link
+func buildRoute(link netlink.Link, r Route) (*netlink.Route, error) {
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Priority: r.Metric, Table: r.Table}
+	if r.Dst != "" {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse route destination %q: %v", r.Dst, err)
+		}
+		route.Dst = dst
+	}
+	if r.Gw != "" {
+		gw := net.ParseIP(r.Gw)
+		if gw == nil {
+			return nil, fmt.Errorf("cannot parse route gateway %q", r.Gw)
+		}
+		route.Gw = gw
+	}
+	scope, err := parseRouteScope(r.Scope)
+	if err != nil {
+		return nil, err
+	}
+	route.Scope = scope
+	return route, nil
+}
+
+// applyLinkConfig applies addresses, routes, MTU, MAC address and the admin
+// up/down state to link, which must already be resident in the namespace the
+// caller intends to configure it in
+func applyLinkConfig(link netlink.Link, addresses []string, routes []Route, mtu int, mac string, up *bool) error {
+	if mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("cannot parse MAC address %q: %v", mac, err)
+		}
+		if err := netlink.LinkSetHardwareAddr(link, hw); err != nil {
+			return fmt.Errorf("cannot set MAC address %q: %v", mac, err)
+		}
+	}
+	if mtu != 0 {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("cannot set MTU %d: %v", mtu, err)
+		}
+	}
+	for _, a := range addresses {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			return fmt.Errorf("cannot parse address %q: %v", a, err)
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("cannot add address %q: %v", a, err)
+		}
+	}
+	if isUp(up) {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("cannot bring link up: %v", err)
+		}
+	}
+	for _, r := range routes {
+		route, err := buildRoute(link, r)
+		if err != nil {
+			return err
+		}
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("cannot add route %+v: %v", r, err)
+		}
+	}
+	return nil
+}
+
+// configureInterface applies L3 configuration (addresses, routes, MTU, MAC
+// address, admin state) to iface inside the network namespace of pid. This
+// lets runtime.json describe a full network setup for a container without
+// that container needing to embed `ip`/`ifconfig` itself.
+func configureInterface(pid int, iface Interface) error {
+	// Up defaults to true when unset, so there is still work to do (bringing
+	// the link up) even when none of the other fields are set
+	if len(iface.Addresses) == 0 && len(iface.Routes) == 0 && iface.MTU == 0 && iface.MacAddress == "" && iface.Master == "" && !isUp(iface.Up) {
+		return nil
+	}
+
+	goruntime.LockOSThread()
+	defer goruntime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("cannot get current network namespace: %v", err)
+	}
+	defer origns.Close()
+
+	targetns, err := netns.GetFromPath(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return fmt.Errorf("cannot open network namespace for pid %d: %v", pid, err)
+	}
+	defer targetns.Close()
+
+	if err := netns.Set(targetns); err != nil {
+		return fmt.Errorf("cannot enter network namespace for pid %d: %v", pid, err)
+	}
+	defer netns.Set(origns)
+
+	link, err := netlink.LinkByName(iface.Name)
+	if err != nil {
+		return fmt.Errorf("cannot find interface %s in namespace for pid %d: %v", iface.Name, pid, err)
+	}
+
+	if iface.Master != "" {
+		master, err := netlink.LinkByName(iface.Master)
+		if err != nil {
+			return fmt.Errorf("cannot find master interface %s: %v", iface.Master, err)
+		}
+		if err := netlink.LinkSetMaster(link, master); err != nil {
+			return fmt.Errorf("cannot enslave %s to %s: %v", iface.Name, iface.Master, err)
+		}
+	}
+
+	return applyLinkConfig(link, iface.Addresses, iface.Routes, iface.MTU, iface.MacAddress, iface.Up)
+}
+
+// configurePeerInterface applies L3 configuration to the root namespace end
+// of a veth pair
+func configurePeerInterface(iface Interface) error {
+	link, err := netlink.LinkByName(iface.Peer)
+	if err != nil {
+		return fmt.Errorf("cannot find peer interface %s: %v", iface.Peer, err)
+	}
+	return applyLinkConfig(link, iface.PeerAddresses, iface.PeerRoutes, 0, "", nil)
+}
+
+// rlimitsMap maps the POSIX resource limit names accepted in runtime.json to
+// their unix.RLIMIT_* constant, analogous to buildah's rlimitsMap
+var rlimitsMap = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// capabilityMap maps the CAP_* names accepted in runtime.json to their
+// gocapability constant
+var capabilityMap = map[string]capability.Cap{
+	"CAP_CHOWN":            capability.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":     capability.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":  capability.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":           capability.CAP_FOWNER,
+	"CAP_FSETID":           capability.CAP_FSETID,
+	"CAP_KILL":             capability.CAP_KILL,
+	"CAP_SETGID":           capability.CAP_SETGID,
+	"CAP_SETUID":           capability.CAP_SETUID,
+	"CAP_SETPCAP":          capability.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":  capability.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE": capability.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":    capability.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":        capability.CAP_NET_ADMIN,
+	"CAP_NET_RAW":          capability.CAP_NET_RAW,
+	"CAP_IPC_LOCK":         capability.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":        capability.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":       capability.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":        capability.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":       capability.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":       capability.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":        capability.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":        capability.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":         capability.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":         capability.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":     capability.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":         capability.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":   capability.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":            capability.CAP_MKNOD,
+	"CAP_LEASE":            capability.CAP_LEASE,
+	"CAP_AUDIT_WRITE":      capability.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":    capability.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":          capability.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":     capability.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":        capability.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":           capability.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":       capability.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":    capability.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":       capability.CAP_AUDIT_READ,
+}
+
+// capsFromNames resolves a list of CAP_* names to gocapability constants
+func capsFromNames(names []string) ([]capability.Cap, error) {
+	caps := make([]capability.Cap, 0, len(names))
+	for _, name := range names {
+		cap, ok := capabilityMap[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, cap)
+	}
+	return caps, nil
+}
+
+// prepareCapabilities drops the calling process's capability sets to exactly
+// those named in caps
+func prepareCapabilities(caps Capabilities) error {
+	c, err := capability.NewPid2(0)
+	if err != nil {
+		return fmt.Errorf("cannot load process capabilities: %v", err)
+	}
+	if err := c.Load(); err != nil {
+		return fmt.Errorf("cannot load process capabilities: %v", err)
+	}
+	// capability.CAPS alone only covers EFFECTIVE|PERMITTED|INHERITABLE; BOUNDS
+	// and AMBS must be included explicitly for the bounding and ambient sets
+	// to actually be cleared and pushed to the kernel
+	const allSets = capability.CAPS | capability.BOUNDS | capability.AMBS
+	c.Clear(allSets)
+
+	sets := []struct {
+		which capability.CapType
+		names []string
+	}{
+		{capability.BOUNDING, caps.Bounding},
+		{capability.EFFECTIVE, caps.Effective},
+		{capability.INHERITABLE, caps.Inheritable},
+		{capability.PERMITTED, caps.Permitted},
+		{capability.AMBIENT, caps.Ambient},
+	}
+	for _, s := range sets {
+		resolved, err := capsFromNames(s.names)
+		if err != nil {
+			return err
+		}
+		for _, cp := range resolved {
+			c.Set(s.which, cp)
+		}
+	}
+
+	if err := c.Apply(allSets); err != nil {
+		return fmt.Errorf("cannot apply capabilities: %v", err)
+	}
+	return nil
+}
+
+// prepareLimits lowers the calling process's rlimits and capabilities before
+// it execs into the container, letting init/onboot containers declaratively
+// lower privileges without patching the OCI spec generator upstream in
+// moby/tool
+func prepareLimits(runtime Runtime) error {
+	for _, rl := range runtime.Rlimits {
+		resource, ok := rlimitsMap[rl.Type]
+		if !ok {
+			return fmt.Errorf("unknown rlimit type %q", rl.Type)
+		}
+		limit := unix.Rlimit{Cur: rl.Soft, Max: rl.Hard}
+		if err := unix.Prlimit(0, resource, &limit, nil); err != nil {
+			return fmt.Errorf("cannot set %s: %v", rl.Type, err)
+		}
+	}
+	// Capabilities is a pointer so that an explicit, fully empty object (drop
+	// every capability) can be distinguished from the field being omitted
+	// entirely (leave capabilities untouched)
+	if runtime.Capabilities == nil {
+		return nil
+	}
+	return prepareCapabilities(*runtime.Capabilities)
+}
+
 // cleanup functions are best efforts only, mainly for rw onboot containers
 func cleanup(path string) {
 	// see if we are dealing with a read only or read write container